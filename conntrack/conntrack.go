@@ -0,0 +1,147 @@
+/*
+Package conntrack provides a TTL cache for correlating in-flight DNS
+queries with their responses.
+
+The naive approach -- keying a map on the 16-bit DNS query ID alone --
+collides whenever two different clients (or the same client, querying
+fast enough) pick the same ID, and leaks memory forever on queries that
+never get a response.  Table instead keys on the same tuple a real
+resolver uses to match a response to a request: the two endpoints, the
+query ID, and the question itself.
+*/
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+//Key identifies one in-flight DNS query.  It intentionally does not
+//include the QR bit or anything else that differs between the query and
+//response legs of the same transaction: callers build the same Key for
+//both by always putting the client endpoint first and the server
+//endpoint second, regardless of which leg they're looking at.
+type Key struct {
+	ClientIP   string
+	ClientPort uint16
+	ServerIP   string
+	ServerPort uint16
+	QueryID    uint16
+	QName      string
+	QType      layers.DNSType
+}
+
+//NewKey builds a Key from a DNS message's question section and the
+//endpoints that should be treated as client and server for that
+//message.  Responses echo back the original question, so the same
+//construction works for both the query and its matching response as
+//long as the caller passes the endpoints in client, server order.
+func NewKey(clientIP net.IP, clientPort uint16, serverIP net.IP, serverPort uint16, dns *layers.DNS) (Key, bool) {
+	if len(dns.Questions) == 0 {
+		return Key{}, false
+	}
+
+	return Key{
+		ClientIP:   clientIP.String(),
+		ClientPort: clientPort,
+		ServerIP:   serverIP.String(),
+		ServerPort: serverPort,
+		QueryID:    dns.ID,
+		QName:      string(dns.Questions[0].Name),
+		QType:      dns.Questions[0].Type,
+	}, true
+}
+
+type tableEntry struct {
+	dns      *layers.DNS
+	transID  string
+	inserted time.Time
+}
+
+//Table is a TTL cache of in-flight DNS queries, safe for concurrent use.
+type Table struct {
+	mu      sync.Mutex
+	maxAge  time.Duration //negative, e.g. -1m -- see cutoff() below
+	entries map[Key]tableEntry
+}
+
+//New returns an empty Table.  maxAge is a negative duration (e.g. -1m),
+//matching the -gc_age flag: an entry older than maxAge is treated as
+//expired, whether that's noticed lazily on lookup or by the periodic
+//Sweep.
+func New(maxAge time.Duration) *Table {
+	return &Table{
+		maxAge:  maxAge,
+		entries: make(map[Key]tableEntry),
+	}
+}
+
+func (t *Table) cutoff() time.Time {
+	return time.Now().Add(t.maxAge)
+}
+
+//Insert records the query leg of a transaction, tagged with the
+//correlation id the caller minted for it.
+func (t *Table) Insert(key Key, dns *layers.DNS, transID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries[key] = tableEntry{dns: dns, transID: transID, inserted: time.Now()}
+}
+
+//LookupAndDelete looks for the query leg matching key.  The entry is
+//removed whether or not it's found, and a lazily-expired entry (past
+//maxAge but not yet swept) is reported as a miss.  The returned
+//correlation id is the same one Insert was given for this query, so the
+//caller can keep tagging log lines for the rest of the transaction.
+func (t *Table) LookupAndDelete(key Key) (*layers.DNS, string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	item, found := t.entries[key]
+	if !found {
+		return nil, "", false
+	}
+
+	delete(t.entries, key)
+
+	if item.inserted.Before(t.cutoff()) {
+		return nil, "", false
+	}
+
+	return item.dns, item.transID, true
+}
+
+//Len returns the number of in-flight queries currently held, for the
+//stats subsystem to report as a gauge.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.entries)
+}
+
+//Sweep evicts every entry older than maxAge and returns the correlation
+//ids of the queries it removed.  It's meant to be called periodically
+//from a background goroutine as a backstop for queries that never get a
+//response and so are never cleaned up by LookupAndDelete; returning the
+//ids lets the caller log each eviction under the same trans_id the query
+//was first seen with.
+func (t *Table) Sweep() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := t.cutoff()
+	var evicted []string
+	for key, item := range t.entries {
+		if item.inserted.Before(cutoff) {
+			delete(t.entries, key)
+			evicted = append(evicted, item.transID)
+		}
+	}
+
+	return evicted
+}
@@ -0,0 +1,57 @@
+package main
+
+import "context"
+
+import log "github.com/Sirupsen/logrus"
+import "github.com/google/uuid"
+
+/*
+Every debug line used to be tagged (if at all) with the raw 16-bit DNS
+query ID via strconv.Itoa(int(dns.ID)), which isn't unique enough to grep
+a single transaction out of a busy capture -- two different clients can
+easily reuse the same ID.  Instead, handleDns mints a correlation id per
+transaction and stores it on a *logrus.Entry carried along on a
+context.Context, the same one that gets passed down into initLogEntry so
+the id also ends up on the outgoing dnsLogEntry as trans_id.
+*/
+
+//logEntryKey is an unexported type so the context value below can't
+//collide with a key some other package might set.
+type logEntryKey struct{}
+
+//withLogEntry returns a child of ctx carrying entry, retrievable with
+//logEntryFrom.
+func withLogEntry(ctx context.Context, entry *log.Entry) context.Context {
+	return context.WithValue(ctx, logEntryKey{}, entry)
+}
+
+//logEntryFrom returns the *log.Entry stashed on ctx by withLogEntry, or
+//a bare entry on the standard logger if ctx was never tagged with one.
+func logEntryFrom(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(logEntryKey{}).(*log.Entry); ok {
+		return entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+//transID returns the trans_id field off of ctx's log entry, or "" if
+//ctx's entry was never tagged with one (e.g. a worker-level context,
+//before any query has been seen).
+func transID(ctx context.Context) string {
+	id, _ := logEntryFrom(ctx).Data["trans_id"].(string)
+	return id
+}
+
+//newTransID mints a correlation id for one query/response transaction.
+//It's a UUIDv7 so ids sort roughly by creation time, which helps when
+//grepping logs for a query that timed out and was GC'd from the
+//conntable long after it was first seen.
+func newTransID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		//entropy failure is effectively unheard of; fall back to a v4
+		//rather than ship a transaction with no correlation id at all
+		id = uuid.New()
+	}
+	return id.String()
+}
@@ -0,0 +1,184 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+
+import "github.com/google/gopacket/layers"
+
+/*
+Each sink picks its own wire format through the Encoder interface
+instead of main.go hardcoding json.Marshal.  Encode returns a slice
+because JSON preserves the historical one-object-per-answer shape (so a
+3-answer response becomes 3 JSON lines), while Zeek/CEF fold every
+answer of a response into a single line.
+*/
+type Encoder interface {
+	//Encode renders entry as zero or more lines, without a trailing newline.
+	Encode(entry dnsLogEntry) ([][]byte, error)
+	//Header returns a line to be written once, before any records, or
+	//nil for formats (JSON, CEF) that don't need one.
+	Header() []byte
+}
+
+//NewEncoder looks up an Encoder by the name used on -format and the
+//per-sink *_format flags.  Unrecognized names fall back to JSON.
+func NewEncoder(format string) Encoder {
+	switch format {
+	case "zeek":
+		return ZeekEncoder{}
+	case "cef":
+		return CEFEncoder{}
+	default:
+		return JSONEncoder{}
+	}
+}
+
+//jsonRecord is the historical flat, one-answer-per-object JSON shape.
+type jsonRecord struct {
+	TransID       string `json:"trans_id"`
+	Query_ID      uint16 `json:"query_id"`
+	Response_Code int    `json:"response_code"`
+	Question      string `json:"question"`
+	Question_Type string `json:"question_type"`
+	Answer        string `json:"answer"`
+	Answer_Type   string `json:"answer_type"`
+	TTL           uint32 `json:"ttl"`
+	Server        net.IP `json:"server"`
+	Client        net.IP `json:"client"`
+	Timestamp     string `json:"timestamp"`
+}
+
+type JSONEncoder struct{}
+
+func (JSONEncoder) Header() []byte { return nil }
+
+func (JSONEncoder) Encode(entry dnsLogEntry) ([][]byte, error) {
+	lines := make([][]byte, 0, len(entry.Answers))
+
+	for i, answer := range entry.Answers {
+		encoded, err := json.Marshal(jsonRecord{
+			TransID:       entry.TransID,
+			Query_ID:      entry.Query_ID,
+			Response_Code: entry.Response_Code,
+			Question:      entry.Question,
+			Question_Type: entry.Question_Type,
+			Answer:        answer,
+			Answer_Type:   entry.Answer_Types[i],
+			TTL:           entry.TTLs[i],
+			Server:        entry.Server,
+			Client:        entry.Client,
+			Timestamp:     entry.Timestamp,
+		})
+		if err != nil {
+			return lines, err
+		}
+
+		lines = append(lines, encoded)
+	}
+
+	return lines, nil
+}
+
+//zeekFields is the Bro/Zeek dns.log column order.
+var zeekFields = []string{
+	"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p",
+	"proto", "trans_id", "query", "qclass_name", "qtype_name", "rcode_name",
+	"answers", "TTLs",
+}
+
+type ZeekEncoder struct{}
+
+func (ZeekEncoder) Header() []byte {
+	return []byte("#fields\t" + strings.Join(zeekFields, "\t"))
+}
+
+//zeekEscape applies Zeek's TSV escaping: tabs and newlines can't appear
+//in a field, and an empty field is written as a literal "-".
+func zeekEscape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	s = strings.Replace(s, "\t", "\\t", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return s
+}
+
+func (ZeekEncoder) Encode(entry dnsLogEntry) ([][]byte, error) {
+	answers := "-"
+	ttls := "-"
+	if len(entry.Answers) > 0 {
+		answers = zeekEscape(strings.Join(entry.Answers, ","))
+
+		ttlParts := make([]string, len(entry.TTLs))
+		for i, ttl := range entry.TTLs {
+			ttlParts[i] = strconv.FormatUint(uint64(ttl), 10)
+		}
+		ttls = strings.Join(ttlParts, ",")
+	}
+
+	//Zeek identifies a connection by a short random UID; our per-
+	//transaction trans_id serves the same purpose, so reuse it here too.
+	uid := entry.TransID
+
+	fields := []string{
+		entry.Timestamp,
+		uid,
+		entry.Client.String(),
+		strconv.Itoa(int(entry.ClientPort)),
+		entry.Server.String(),
+		strconv.Itoa(int(entry.ServerPort)),
+		entry.Proto,
+		strconv.Itoa(int(entry.Query_ID)),
+		zeekEscape(entry.Question),
+		"C_INTERNET",
+		zeekEscape(entry.Question_Type),
+		layers.DNSResponseCode(entry.Response_Code).String(),
+		answers,
+		ttls,
+	}
+
+	return [][]byte{[]byte(strings.Join(fields, "\t"))}, nil
+}
+
+type CEFEncoder struct{}
+
+func (CEFEncoder) Header() []byte { return nil }
+
+//cefEscape applies CEF's extension-field escaping: backslash and equals
+//need escaping, and newlines aren't allowed.
+func cefEscape(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "=", "\\=", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return s
+}
+
+func (CEFEncoder) Encode(entry dnsLogEntry) ([][]byte, error) {
+	ttlParts := make([]string, len(entry.TTLs))
+	for i, ttl := range entry.TTLs {
+		ttlParts[i] = strconv.FormatUint(uint64(ttl), 10)
+	}
+
+	ext := fmt.Sprintf(
+		"rt=%s src=%s spt=%d dst=%s dpt=%d requestMethod=DNS request=%s "+
+			"cs1Label=qtype cs1=%s outcome=%s cs2Label=answers cs2=%s cs3Label=ttls cs3=%s "+
+			"cs4Label=transId cs4=%s",
+		entry.Timestamp,
+		entry.Client.String(), entry.ClientPort,
+		entry.Server.String(), entry.ServerPort,
+		cefEscape(entry.Question),
+		cefEscape(entry.Question_Type),
+		layers.DNSResponseCode(entry.Response_Code).String(),
+		cefEscape(strings.Join(entry.Answers, ",")),
+		strings.Join(ttlParts, ","),
+		cefEscape(entry.TransID),
+	)
+
+	line := fmt.Sprintf("CEF:0|gopassivedns|gopassivedns|1.0|%d|DNS %s query|3|%s",
+		entry.Response_Code, entry.Question_Type, ext)
+
+	return [][]byte{[]byte(line)}, nil
+}
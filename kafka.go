@@ -0,0 +1,204 @@
+package main
+
+import "strings"
+import "sync"
+import "time"
+
+import log "github.com/Sirupsen/logrus"
+import "github.com/Shopify/sarama"
+
+import "github.com/Jdi99y515/gopassivedns/stats"
+
+//how many messages to hold onto when Kafka can't keep up, before we
+//start dropping the oldest queued message to make room for new ones
+const kafkaQueueDepth = 10000
+
+//how often the kafka sink retries draining its overflow queue into the
+//producer once Kafka has fallen behind
+const kafkaRetryInterval = 100 * time.Millisecond
+
+func newKafkaProducer(brokers string, compression string, acks string) sarama.AsyncProducer {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = false
+	config.Producer.Return.Errors = true
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+
+	switch compression {
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	default:
+		config.Producer.Compression = sarama.CompressionNone
+	}
+
+	switch acks {
+	case "all", "-1":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "none", "0":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	}
+
+	producer, err := sarama.NewAsyncProducer(strings.Split(brokers, ","), config)
+	if err != nil {
+		log.Fatal("could not connect to Kafka brokers: " + err.Error())
+	}
+
+	return producer
+}
+
+//kafkaQueue is a small bounded FIFO of messages we couldn't immediately
+//hand to the producer.  Once it's full, pushing a new message drops the
+//oldest one rather than growing without bound or blocking the sink.
+type kafkaQueue struct {
+	mu    sync.Mutex
+	items []*sarama.ProducerMessage
+}
+
+func (q *kafkaQueue) push(msg *sarama.ProducerMessage) (droppedOldest bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) >= kafkaQueueDepth {
+		q.items = q.items[1:]
+		droppedOldest = true
+	}
+	q.items = append(q.items, msg)
+
+	return
+}
+
+//pushFront re-queues a message that failed to send so it's retried
+//before anything that arrived after it, preserving per-client ordering.
+func (q *kafkaQueue) pushFront(msg *sarama.ProducerMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append([]*sarama.ProducerMessage{msg}, q.items...)
+}
+
+func (q *kafkaQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+func (q *kafkaQueue) pop() (*sarama.ProducerMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	msg := q.items[0]
+	q.items = q.items[1:]
+
+	return msg, true
+}
+
+//shutdown is closed once, by main, when the process catches SIGTERM;
+//logConnKafka drains its overflow queue into the producer before
+//returning, so main can wait on it before the process actually exits.
+func logConnKafka(logC chan dnsLogEntry, kafkaBrokers string, kafkaTopic string,
+	kafkaCompression string, kafkaAcks string, kafkaPartitionKey string,
+	encoder Encoder, statsClient stats.Client, shutdown <-chan struct{}) {
+
+	producer := newKafkaProducer(kafkaBrokers, kafkaCompression, kafkaAcks)
+
+	go func() {
+		for err := range producer.Errors() {
+			log.Debug("kafka producer error: " + err.Err.Error())
+			statsClient.Incr("sink.kafka.errors", 1)
+		}
+	}()
+
+	queue := &kafkaQueue{}
+	retry := time.NewTicker(kafkaRetryInterval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case message, ok := <-logC:
+			if !ok {
+				producer.AsyncClose()
+				return
+			}
+
+			lines, err := encoder.Encode(message)
+			if err != nil {
+				log.WithField("trans_id", message.TransID).Debug("error encoding log entry: " + err.Error())
+				statsClient.Incr("sink.kafka.errors", 1)
+				continue
+			}
+
+			for _, line := range lines {
+				msg := &sarama.ProducerMessage{
+					Topic: kafkaTopic,
+					Value: sarama.ByteEncoder(line),
+				}
+				//partition all queries from one client together, so a host's
+				//lookups stay in order on a single partition
+				if kafkaPartitionKey == "client" && message.Client != nil {
+					msg.Key = sarama.StringEncoder(message.Client.String())
+				}
+
+				//if anything's already queued, it has to go first - otherwise
+				//this message could overtake older backlogged ones the moment
+				//the producer has spare capacity, breaking per-client ordering
+				if queue.len() > 0 {
+					if queue.push(msg) {
+						statsClient.Incr("sink.kafka.dropped", 1)
+					}
+					continue
+				}
+
+				select {
+				case producer.Input() <- msg:
+					statsClient.Incr("sink.kafka.writes", 1)
+				default:
+					if queue.push(msg) {
+						statsClient.Incr("sink.kafka.dropped", 1)
+					}
+				}
+			}
+
+		case <-retry.C:
+		drain:
+			for {
+				msg, ok := queue.pop()
+				if !ok {
+					break
+				}
+				select {
+				case producer.Input() <- msg:
+					statsClient.Incr("sink.kafka.writes", 1)
+				default:
+					//still backed up; put it back at the front so it's retried
+					//ahead of anything queued after it
+					queue.pushFront(msg)
+					break drain
+				}
+			}
+
+		case <-shutdown:
+			log.Debug("kafka sink caught shutdown signal, flushing queue before exit")
+			for {
+				msg, ok := queue.pop()
+				if !ok {
+					break
+				}
+				producer.Input() <- msg
+			}
+			//Close, unlike AsyncClose, waits for the producer's own buffers
+			//to be flushed to the brokers before returning
+			if err := producer.Close(); err != nil {
+				log.Debug("error flushing kafka producer on shutdown: " + err.Error())
+			}
+			return
+		}
+	}
+}
@@ -1,35 +1,37 @@
 package main
 
+import "context"
 import "flag"
 import "fmt"
 import log "github.com/Sirupsen/logrus"
 import "strconv"
+import "sync"
 import "time"
 import "net"
 import "os"
-import "encoding/json"
+import "os/signal"
+import "syscall"
 
-//import "github.com/Shopify/sarama"
 import "github.com/google/gopacket"
 import "github.com/google/gopacket/pcap"
 import "github.com/google/gopacket/layers"
+import "github.com/google/gopacket/tcpassembly"
+
+import "github.com/Jdi99y515/gopassivedns/conntrack"
+import "github.com/Jdi99y515/gopassivedns/stats"
 
 /*
 Plans:
 
     -code cleanup (e.g. break up handlePacket, switch everything to camelCase)
-    stats output
     perf testing
 release v2
 
-	deal with DNS Length header in TCP
     re-build error handling with panic()/recover()
     syslog logging
-    logging to kafka
     add PF_RING support
 release v3
 
-    maybe use something with a larger keyspace than the query ID for the conntable map
     maybe not so many string conversions?
     add more Types to gopacket
 */
@@ -39,58 +41,53 @@ release v3
 DNS log entry struct and helper functions
 
 */
+//dnsLogEntry holds one fully-resolved query/response transaction. All of
+//a response's answers are grouped onto a single entry instead of one
+//entry per answer -- that's the shape Zeek/CEF expect, and the JSONEncoder
+//unpacks it back into the historical one-object-per-answer records.
 type dnsLogEntry struct {
-	Query_ID      uint16 `json:"query_id"`
-	Response_Code int    `json:"response_code"`
-	Question      string `json:"question"`
-	Question_Type string `json:"question_type"`
-	Answer        string `json:"answer"`
-	Answer_Type   string `json:"answer_type"`
-	TTL           uint32 `json:"ttl"`
-	Server        net.IP `json:"server"`
-	Client        net.IP `json:"client"`
-	Timestamp     string `json:"timestamp"`
-
-	encoded []byte //to hold the marshaled data structure
-	err     error  //encoding errors
-}
-
-func (dle *dnsLogEntry) ensureEncoded() {
-	if dle.encoded == nil && dle.err == nil {
-		dle.encoded, dle.err = json.Marshal(dle)
-	}
-}
-
-func (dle *dnsLogEntry) Length() int {
-	dle.ensureEncoded()
-	return len(dle.encoded)
-}
-
-func (dle *dnsLogEntry) Encode() ([]byte, error) {
-	dle.ensureEncoded()
-	return dle.encoded, dle.err
-}
-
-type dnsMapEntry struct {
-	entry    *layers.DNS
-	inserted time.Time
+	TransID       string
+	Query_ID      uint16
+	Response_Code int
+	Question      string
+	Question_Type string
+	Answers       []string
+	Answer_Types  []string
+	TTLs          []uint32
+	Server        net.IP
+	ServerPort    uint16
+	Client        net.IP
+	ClientPort    uint16
+	Timestamp     string
+	//Proto is the transport the response was seen over: "udp" or "tcp".
+	Proto string
 }
 
 //background task to clear out stale entries in the conntable
 //one of these gets spun up for every packet handling thread
-func cleanDnsCache(conntable *map[uint16]dnsMapEntry, maxAge time.Duration, interval time.Duration) {
+func cleanDnsCache(conntable *conntrack.Table, interval time.Duration, statsClient stats.Client, workerID int) {
+
+	workerStat := "conntable." + strconv.Itoa(workerID)
+	logger := log.WithField("worker", workerID)
 
 	for {
 		time.Sleep(interval)
 
-		//max_age should be negative, e.g. -1m
-		cleanupCutoff := time.Now().Add(maxAge)
-		for key, item := range *conntable {
-			if item.inserted.Before(cleanupCutoff) {
-				log.Debug("conntable GC: cleanup query ID " + strconv.Itoa(int(key)))
-				delete(*conntable, key)
+		evicted := conntable.Sweep()
+		if len(evicted) > 0 {
+			logger.Debug("conntable GC: evicted " + strconv.Itoa(len(evicted)) + " stale entries")
+			//tagging each eviction with its trans_id is debug-only detail
+			//(a stale query's original sighting is only worth tracing
+			//down when debug logging is already on), so skip the
+			//per-entry WithField allocations otherwise
+			if log.GetLevel() >= log.DebugLevel {
+				for _, id := range evicted {
+					logger.WithField("trans_id", id).Debug("conntable GC: evicted a stale query")
+				}
 			}
 		}
+		statsClient.Incr(workerStat+".gc_evictions", int64(len(evicted)))
+		statsClient.Gauge(workerStat+".size", int64(conntable.Len()))
 	}
 }
 
@@ -124,6 +121,22 @@ func TypeString(dnsType layers.DNSType) string {
 		return "SOA"
 	case layers.DNSTypeSRV:
 		return "SRV"
+	case dnsTypeNAPTR:
+		return "NAPTR"
+	case dnsTypeDS:
+		return "DS"
+	case dnsTypeRRSIG:
+		return "RRSIG"
+	case dnsTypeNSEC:
+		return "NSEC"
+	case dnsTypeDNSKEY:
+		return "DNSKEY"
+	case dnsTypeSVCB:
+		return "SVCB"
+	case dnsTypeHTTPS:
+		return "HTTPS"
+	case dnsTypeCAA:
+		return "CAA"
 	case 255: //ANY query per http://tools.ietf.org/html/rfc1035#page-12
 		return "ANY"
 	}
@@ -136,35 +149,6 @@ func TypeString(dnsType layers.DNSType) string {
    little worried about the perf impact of doing string conversions
    in this thread...
 */
-func RrString(rr layers.DNSResourceRecord) string {
-	switch rr.Type {
-	default:
-		//take a blind stab...at least this shouldn't *lose* data
-		return string(rr.Data)
-	case layers.DNSTypeA:
-		return rr.IP.String()
-	case layers.DNSTypeAAAA:
-		return rr.IP.String()
-	case layers.DNSTypeCNAME:
-		return string(rr.CNAME)
-	case layers.DNSTypeMX:
-		//TODO: add the priority
-		return string(rr.MX.Name)
-	case layers.DNSTypeNS:
-		return string(rr.NS)
-	case layers.DNSTypePTR:
-		return string(rr.PTR)
-	case layers.DNSTypeTXT:
-		return string(rr.TXT)
-	case layers.DNSTypeSOA:
-		//TODO: rebuild the full SOA string
-		return string(rr.SOA.RName)
-	case layers.DNSTypeSRV:
-		//TODO: rebuild the full SRV string
-		return string(rr.SRV.Name)
-	}
-}
-
 func getIpaddrs(packet gopacket.Packet) (net.IP, net.IP) {
 	var srcIP net.IP = nil
 	var dstIP net.IP = nil
@@ -185,65 +169,66 @@ func getIpaddrs(packet gopacket.Packet) (net.IP, net.IP) {
 	return srcIP, dstIP
 }
 
-func initLogEntry(srcIP net.IP, dstIP net.IP, question *layers.DNS, reply *layers.DNS) []dnsLogEntry {
-	var retArray []dnsLogEntry
+//getPorts pulls the transport-layer ports out of a UDP or TCP packet, so
+//the conntrack key can include them alongside the IPs.
+func getPorts(packet gopacket.Packet) (uint16, uint16) {
+	if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		udp, _ := udpLayer.(*layers.UDP)
+		return uint16(udp.SrcPort), uint16(udp.DstPort)
+	} else if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp, _ := tcpLayer.(*layers.TCP)
+		return uint16(tcp.SrcPort), uint16(tcp.DstPort)
+	}
 
+	return 0, 0
+}
+
+//initLogEntry builds the single grouped dnsLogEntry for a completed
+//query/response transaction.  A successful ANY query may carry many
+//answers; they all land on this one entry's Answers/Answer_Types/TTLs,
+//in the same order, rather than producing one entry per answer.
+func initLogEntry(ctx context.Context, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	question *layers.DNS, reply *layers.DNS, proto string) dnsLogEntry {
 	/*
 	   http://forums.devshed.com/dns-36/dns-packet-question-section-1-a-183026.html
-	   multiple questions isn't really a thing, so we'll loop over the answers and
-	   insert the question section from the original query.  This means a successful
-	   ANY query may result in a lot of seperate log entries.  The query ID will be
-	   the same on all of those entries, however, so you can rebuild the query that
-	   way.
+	   multiple questions isn't really a thing, so we just use the question
+	   section from the original query.
 
 	   TODO: Also loop through Additional records in addition to Answers
 	*/
 
-	//a response code other than 0 means failure of some kind
+	entry := dnsLogEntry{
+		TransID:       transID(ctx),
+		Query_ID:      reply.ID,
+		Question:      string(question.Questions[0].Name),
+		Response_Code: int(reply.ResponseCode),
+		Question_Type: TypeString(question.Questions[0].Type),
+		//this is the answer packet, which comes from the server...
+		Server:     srcIP,
+		ServerPort: srcPort,
+		//...and goes to the client
+		Client:     dstIP,
+		ClientPort: dstPort,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Proto:      proto,
+	}
 
+	//a response code other than 0 means failure of some kind, and there
+	//won't be any answers to report
 	if reply.ResponseCode != 0 {
+		entry.Answers = []string{reply.ResponseCode.String()}
+		entry.Answer_Types = []string{""}
+		entry.TTLs = []uint32{0}
+		return entry
+	}
 
-		tmpEntry := dnsLogEntry{
-			Query_ID:      reply.ID,
-			Question:      string(question.Questions[0].Name),
-			Response_Code: int(reply.ResponseCode),
-			Question_Type: TypeString(question.Questions[0].Type),
-			Answer:        reply.ResponseCode.String(),
-			Answer_Type:   "",
-			TTL:           0,
-			//this is the answer packet, which comes from the server...
-			Server: srcIP,
-			//...and goes to the client
-			Client:    dstIP,
-			Timestamp: time.Now().UTC().Format(time.RFC3339),
-		}
-		retArray = append(retArray, tmpEntry)
-
-		return retArray
-
-	} else {
-		for _, answer := range reply.Answers {
-
-			tmpEntry := dnsLogEntry{
-				Query_ID:      reply.ID,
-				Question:      string(question.Questions[0].Name),
-				Response_Code: int(reply.ResponseCode),
-				Question_Type: TypeString(question.Questions[0].Type),
-				Answer:        RrString(answer),
-				Answer_Type:   TypeString(answer.Type),
-				TTL:           answer.TTL,
-				//this is the answer packet, which comes from the server...
-				Server: srcIP,
-				//...and goes to the client
-				Client:    dstIP,
-				Timestamp: time.Now().UTC().Format(time.RFC3339),
-			}
-
-			retArray = append(retArray, tmpEntry)
-		}
-
-		return retArray
+	for _, answer := range reply.Answers {
+		entry.Answers = append(entry.Answers, RrString(answer))
+		entry.Answer_Types = append(entry.Answer_Types, TypeString(answer.Type))
+		entry.TTLs = append(entry.TTLs, answer.TTL)
 	}
+
+	return entry
 }
 
 func getDnsLayer(packet gopacket.Packet) *layers.DNS {
@@ -256,105 +241,122 @@ func getDnsLayer(packet gopacket.Packet) *layers.DNS {
 			log.Debug(packet.String())
 			return nil
 		}
-	} else if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-		/*
-			DNS over TCP prefixes the DNS header with a 2-octet length field.
-			gopacket doesn't handle this at all...and as far as I can tell might
-			not be able to (layer parsers don't seem to be able to see anything
-			about previous layers).
-
-			Additionally, I've yet to find the magic LayerType that gives me a layer
-			called Payload (which is GoPacket for Data we can't parse)..so we do this
-
-			In reality we should actually care about the length field...but that will
-			come later, as we can't actually even parse the response types that are
-			likely to span multiple packets.
-		*/
-		for _, layer := range packet.Layers() {
-			if layer.LayerType().String() == "Payload" {
-				//offset the LayerContents to skip the length field
-				if dnsP := gopacket.NewPacket(layer.LayerContents()[2:], layers.LayerTypeDNS,
-					gopacket.Default); dnsP != nil {
-					return dnsP.Layers()[0].(*layers.DNS)
-				} else {
-					log.Debug("Got a non-DNS TCP packet")
-					log.Debug(packet.String())
-					return nil
-				}
-			}
-		}
-		// non-paylod TCP packets
-		return nil
 	}
 
-	log.Debug("Got a packet that is neither TCP nor UDP")
-	log.Debug(packet.String())
-
+	//TCP DNS is handled separately, by reassembling the stream in
+	//doCapture() via tcpassembly and feeding the results straight into
+	//handleDns() -- see tcp.go.  A bare TCP packet never carries a whole
+	//DNS message on its own, so there's nothing useful to return here.
 	return nil
 }
 
-/* validate if DNS, make conntable entry and output
-   to log channel if there is a match
-*/
-func handlePacket(packets chan gopacket.Packet, logC chan dnsLogEntry,
-	gcInterval time.Duration, gcAge time.Duration) {
+//match a single DNS packet (query or response) against the conntable and
+//ship a log entry out when a response completes a query.  This is the
+//common path for both UDP packets and reassembled TCP messages.
+func handleDns(ctx context.Context, conntable *conntrack.Table, logC chan dnsLogEntry, dns *layers.DNS,
+	srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, proto string, statsClient stats.Client) {
+
+	//skip non-query stuff (Updates, AXFRs, etc)
+	if dns.OpCode != layers.DNSOpCodeQuery {
+		logEntryFrom(ctx).Debug("Saw non-query DNS packet")
+		statsClient.Incr("dns.nonquery_opcode", 1)
+		return
+	}
 
-	//DNS IDs are stored as uint16s by the gopacket DNS layer
-	//TODO: fix the memory leak of failed lookups by making this a ttlcache
-	var conntable = make(map[uint16]dnsMapEntry)
+	//this is a Query Response packet: server (src) -> client (dst)
+	if dns.QR {
+		key, ok := conntrack.NewKey(dstIP, dstPort, srcIP, srcPort, dns)
+		if !ok {
+			logEntryFrom(ctx).Debug("Got a Query Response with no question section")
+			return
+		}
 
-	//setup garbage collection for this map
-	go cleanDnsCache(&conntable, gcAge, gcInterval)
+		question, id, found := conntable.LookupAndDelete(key)
+		if !found {
+			//This might happen if we get a query ID collision, or if the
+			//query leg was already GC'd for taking too long to answer
+			logEntryFrom(ctx).Debug("Got a Query Response and can't find a query for ID " + strconv.Itoa(int(dns.ID)))
+			statsClient.Incr("dns.response.unmatched", 1)
+			return
+		}
 
-	for packet := range packets {
-		srcIP, dstIP := getIpaddrs(packet)
-		dns := getDnsLayer(packet)
+		//tag the rest of this transaction with the id it was first seen
+		//under, so the eventual dnsLogEntry carries it too
+		respCtx := withLogEntry(ctx, logEntryFrom(ctx).WithField("trans_id", id))
+		logEntryFrom(respCtx).Debug("Got 'answer' leg of query ID: " + strconv.Itoa(int(dns.ID)))
+		statsClient.Incr("dns.response.matched", 1)
+		logC <- initLogEntry(respCtx, srcIP, srcPort, dstIP, dstPort, question, dns, proto)
 
-		if dns == nil {
-			continue
+	} else {
+		//This is the initial query: client (src) -> server (dst).  Save it for later.
+		key, ok := conntrack.NewKey(srcIP, srcPort, dstIP, dstPort, dns)
+		if !ok {
+			logEntryFrom(ctx).Debug("Got a query with no question section")
+			return
 		}
 
-		// Get actual DNS data from this layer
-		//dns, _ := dnsLayer.(*layers.DNS)
+		id := newTransID()
+		queryCtx := withLogEntry(ctx, logEntryFrom(ctx).WithField("trans_id", id))
+		logEntryFrom(queryCtx).Debug("Got the 'question' leg of query ID " + strconv.Itoa(int(dns.ID)))
+		statsClient.Incr("dns.query", 1)
+		conntable.Insert(key, dns, id)
+	}
+}
 
-		//skip non-query stuff (Updates, AXFRs, etc)
-		if dns.OpCode != layers.DNSOpCodeQuery {
-			log.Debug("Saw non-update DNS packet: " + packet.String())
-			continue
-		}
+/* validate if DNS, make conntable entry and output
+   to log channel if there is a match
+
+   Handles both raw packets (UDP) coming off the capture and already
+   reassembled DNS messages (TCP) coming out of tcpassembly; both land on
+   the same conntable so a query seen over one transport still matches a
+   response seen over the same one.
+*/
+func handlePacket(workerID int, packets chan gopacket.Packet, tcpMsgs chan dnsStreamMsg, logC chan dnsLogEntry,
+	gcInterval time.Duration, gcAge time.Duration, statsClient stats.Client) {
+
+	conntable := conntrack.New(gcAge)
 
-		item, foundItem := conntable[dns.ID]
+	//setup garbage collection for this table
+	go cleanDnsCache(conntable, gcInterval, statsClient, workerID)
 
-		//this is a Query Response packet
-		if dns.QR && foundItem {
-			question := item.entry
-			//We have both legs of the connection, so drop the connection from the table
-			log.Debug("Got 'answer' leg of query ID: " + strconv.Itoa(int(question.ID)))
-			delete(conntable, question.ID)
+	//every debug line this worker produces carries its worker id;
+	//handleDns tags it further with a per-transaction trans_id
+	ctx := withLogEntry(context.Background(), log.WithField("worker", workerID))
 
-			for _, logEntry := range initLogEntry(srcIP, dstIP, question, dns) {
-				logC <- logEntry
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				return
 			}
+			srcIP, dstIP := getIpaddrs(packet)
+			srcPort, dstPort := getPorts(packet)
+			dns := getDnsLayer(packet)
 
-		} else if dns.QR && !foundItem {
-			//This might happen if we get a query ID collision
-			log.Debug("Got a Query Response and can't find a query for ID " + strconv.Itoa(int(dns.ID)))
-			continue
-		} else {
-			//This is the initial query.  save it for later.
-			log.Debug("Got the 'question' leg of query ID " + strconv.Itoa(int(dns.ID)))
-			mapEntry := dnsMapEntry{
-				entry:    dns,
-				inserted: time.Now(),
+			if dns == nil {
+				statsClient.Incr("packets.nondns", 1)
+				continue
+			}
+
+			//only non-TCP packets ever reach this channel; doCapture feeds
+			//TCP packets straight into tcpassembly instead (see tcp.go)
+			handleDns(ctx, conntable, logC, dns, srcIP, srcPort, dstIP, dstPort, "udp", statsClient)
+
+		case msg, ok := <-tcpMsgs:
+			if !ok {
+				return
 			}
-			conntable[dns.ID] = mapEntry
+			handleDns(ctx, conntable, logC, msg.dns, msg.srcIP, msg.srcPort, msg.dstIP, msg.dstPort, "tcp", statsClient)
 		}
 	}
 }
 
 //Round-robin log messages to log sinks
 func logConn(logC chan dnsLogEntry, quiet bool,
-	filename string, kafkaBrokers string, kafkaTopic string) {
+	filename string, kafkaBrokers string, kafkaTopic string,
+	kafkaCompression string, kafkaAcks string, kafkaPartitionKey string,
+	stdoutFormat string, logfileFormat string, kafkaFormat string, statsClient stats.Client,
+	shutdown <-chan struct{}, wg *sync.WaitGroup) {
 
 	var logs []chan dnsLogEntry
 
@@ -362,21 +364,26 @@ func logConn(logC chan dnsLogEntry, quiet bool,
 		log.Debug("STDOUT logging enabled")
 		stdoutChan := make(chan dnsLogEntry)
 		logs = append(logs, stdoutChan)
-		go logConnStdout(stdoutChan)
+		go logConnStdout(stdoutChan, NewEncoder(stdoutFormat), statsClient)
 	}
 
 	if filename != "" {
 		log.Debug("file logging enabled to " + filename)
 		fileChan := make(chan dnsLogEntry)
 		logs = append(logs, fileChan)
-		go logConnFile(fileChan, filename)
+		go logConnFile(fileChan, filename, NewEncoder(logfileFormat), statsClient)
 	}
 
-	if kafkaBrokers != "" && kafkaTopic != "" && false {
+	if kafkaBrokers != "" && kafkaTopic != "" {
 		log.Debug("kafka logging enabled")
 		kafkaChan := make(chan dnsLogEntry)
 		logs = append(logs, kafkaChan)
-		go logConnKafka(kafkaChan, kafkaBrokers, kafkaTopic)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logConnKafka(kafkaChan, kafkaBrokers, kafkaTopic, kafkaCompression, kafkaAcks, kafkaPartitionKey,
+				NewEncoder(kafkaFormat), statsClient, shutdown)
+		}()
 	}
 
 	//setup is done, now we sit here and dispatch messages to the configured sinks
@@ -387,14 +394,27 @@ func logConn(logC chan dnsLogEntry, quiet bool,
 	}
 }
 
-func logConnStdout(logC chan dnsLogEntry) {
+func logConnStdout(logC chan dnsLogEntry, encoder Encoder, statsClient stats.Client) {
+	if header := encoder.Header(); header != nil {
+		fmt.Println(string(header))
+	}
+
 	for message := range logC {
-		encoded, _ := message.Encode()
-		fmt.Println(string(encoded))
+		lines, err := encoder.Encode(message)
+		if err != nil {
+			log.WithField("trans_id", message.TransID).Debug("error encoding log entry: " + err.Error())
+			statsClient.Incr("sink.stdout.errors", 1)
+			continue
+		}
+
+		for _, line := range lines {
+			fmt.Println(string(line))
+		}
+		statsClient.Incr("sink.stdout.writes", 1)
 	}
 }
 
-func logConnFile(logC chan dnsLogEntry, filename string) {
+func logConnFile(logC chan dnsLogEntry, filename string, encoder Encoder, statsClient stats.Client) {
 
 	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
@@ -404,17 +424,26 @@ func logConnFile(logC chan dnsLogEntry, filename string) {
 
 	defer f.Close()
 
-	for message := range logC {
-		encoded, _ := message.Encode()
-		f.WriteString(string(encoded) + "\n")
+	if header := encoder.Header(); header != nil {
+		f.WriteString(string(header) + "\n")
 	}
-}
 
-func logConnKafka(logC chan dnsLogEntry, kafkaBrokers string, kafkaTopic string) {
 	for message := range logC {
-		//marshal to JSON.  Maybe we should do this in the log thread?
-		encoded, _ := message.Encode()
-		fmt.Println("Kafka: " + string(encoded))
+		lines, err := encoder.Encode(message)
+		if err != nil {
+			log.WithField("trans_id", message.TransID).Debug("error encoding log entry: " + err.Error())
+			statsClient.Incr("sink.file.errors", 1)
+			continue
+		}
+
+		for _, line := range lines {
+			if _, err := f.WriteString(string(line) + "\n"); err != nil {
+				log.WithField("trans_id", message.TransID).Debug("error writing to logfile: " + err.Error())
+				statsClient.Incr("sink.file.errors", 1)
+				continue
+			}
+			statsClient.Incr("sink.file.writes", 1)
+		}
 	}
 }
 
@@ -449,8 +478,12 @@ func initHandle(dev string, pcapFile string, bpf string) *pcap.Handle {
 	return handle
 }
 
+//how many packets a worker's channel will buffer before doCapture starts
+//dropping rather than blocking the capture loop
+const channelDepth = 1000
+
 func doCapture(handle *pcap.Handle, logChan chan dnsLogEntry,
-	gcAge string, gcInterval string) {
+	gcAge string, gcInterval string, statsClient stats.Client, statsInterval time.Duration) {
 
 	gcAgeDur, err := time.ParseDuration(gcAge)
 
@@ -464,27 +497,81 @@ func doCapture(handle *pcap.Handle, logChan chan dnsLogEntry,
 		log.Fatal("Your gc_age parameter was not parseable.  Use a string like '3m'")
 	}
 
-	/* init channels for the packet handlers and kick off handler threads */
+	/* init channels for the packet handlers and kick off handler threads.
+	   Each worker also gets its own tcpassembly.Assembler, fed straight
+	   from doCapture below, so that TCP DNS (which may span many
+	   segments) reassembles into whole messages before ever reaching
+	   handlePacket's conntable. */
 	var channels [8]chan gopacket.Packet
+	var assemblers [8]*tcpassembly.Assembler
 	for i := 0; i < 8; i++ {
-		channels[i] = make(chan gopacket.Packet)
-		go handlePacket(channels[i], logChan, gcIntervalDur, gcAgeDur)
+		channels[i] = make(chan gopacket.Packet, channelDepth)
+
+		tcpMsgs := make(chan dnsStreamMsg)
+		streamFactory := &dnsStreamFactory{tcpMsgs: tcpMsgs}
+		streamPool := tcpassembly.NewStreamPool(streamFactory)
+		assemblers[i] = tcpassembly.NewAssembler(streamPool)
+
+		go handlePacket(i, channels[i], tcpMsgs, logChan, gcIntervalDur, gcAgeDur, statsClient)
 	}
 
+	//report how full each worker's channel is, so operators can tell
+	//whether the 8-way fanout is keeping up
+	go func() {
+		for {
+			time.Sleep(statsInterval)
+			for i, channel := range channels {
+				statsClient.Gauge("channel."+strconv.Itoa(i)+".depth", int64(len(channel)))
+			}
+		}
+	}()
+
 	// Use the handle as a packet source to process all packets
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	//only decode packet in response to function calls, this moves the
 	//packet processing to the processing threads
 	packetSource.DecodeOptions = gopacket.Lazy
-	for packet := range packetSource.Packets() {
-		// Dispatch packets here
-		if net := packet.NetworkLayer(); net != nil {
-			/*  load balance the processiing over 8 threads
-			    FashHash is consistant for A->B and B->A hashes, which simplifies
-			    our connection tracking problem a bit by letting us keep
-			    per-worker connection pools instead of a global pool.
-			*/
-			channels[int(net.NetworkFlow().FastHash())&0x7] <- packet
+	packets := packetSource.Packets()
+
+	//evict idle half-streams on the same cadence as the conntable GC.
+	//This has to run on this same goroutine, alongside AssembleWithTimestamp
+	//below, since tcpassembly.Assembler isn't safe for concurrent use.
+	gcTicker := time.NewTicker(gcIntervalDur)
+	defer gcTicker.Stop()
+
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			statsClient.Incr("packets.received", 1)
+
+			// Dispatch packets here
+			if net := packet.NetworkLayer(); net != nil {
+				/*  load balance the processiing over 8 threads
+				    FashHash is consistant for A->B and B->A hashes, which simplifies
+				    our connection tracking problem a bit by letting us keep
+				    per-worker connection pools instead of a global pool.
+				*/
+				idx := int(net.NetworkFlow().FastHash()) & 0x7
+
+				if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+					assemblers[idx].AssembleWithTimestamp(net.NetworkFlow(), tcpLayer.(*layers.TCP),
+						packet.Metadata().Timestamp)
+				} else {
+					select {
+					case channels[idx] <- packet:
+					default:
+						//worker can't keep up; drop rather than stall the capture loop
+						statsClient.Incr("packets.dropped", 1)
+					}
+				}
+			}
+
+		case <-gcTicker.C:
+			flushOldStreams(assemblers[:], gcAgeDur)
 		}
 	}
 }
@@ -508,6 +595,9 @@ func main() {
 	var dev = flag.String("dev", "", "Capture Device")
 	var kafkaBrokers = flag.String("kafka_brokers", os.Getenv("KAFKA_PEERS"), "The Kafka brokers to connect to, as a comma separated list")
 	var kafkaTopic = flag.String("kafka_topic", "", "Kafka topic for output")
+	var kafkaCompression = flag.String("kafka_compression", "none", "Kafka producer compression: none, snappy, or gzip")
+	var kafkaAcks = flag.String("kafka_acks", "local", "Kafka required_acks: none, local, or all")
+	var kafkaPartitionKey = flag.String("kafka_partition_key", "client", "Field to derive the Kafka partition key from: client or none")
 	var bpf = flag.String("bpf", "port 53", "BPF Filter")
 	var pcapFile = flag.String("pcap", "", "pcap file")
 	var logFile = flag.String("logfile", "", "log file (recommended for debug only")
@@ -515,6 +605,13 @@ func main() {
 	var gcAge = flag.String("gc_age", "-1m", "How old a connection table entry should be before it is garbage collected.")
 	var gcInterval = flag.String("gc_interval", "3m", "How often to run garbage collection.")
 	var debug = flag.Bool("debug", false, "Enable debug logging")
+	var statsdHost = flag.String("statsd_host", "", "statsd host:port to send metrics to (disabled if unset)")
+	var statsdPrefix = flag.String("statsd_prefix", "gopassivedns", "Prefix to apply to all statsd metrics")
+	var statsdInterval = flag.String("statsd_interval", "2s", "How often to flush buffered metrics to statsd")
+	var format = flag.String("format", "json", "Default output format: json, zeek, or cef")
+	var stdoutFormat = flag.String("stdout_format", "", "Output format for stdout (defaults to -format)")
+	var logfileFormat = flag.String("logfile_format", "", "Output format for -logfile (defaults to -format)")
+	var kafkaFormat = flag.String("kafka_format", "", "Output format for the Kafka sink (defaults to -format)")
 
 	flag.Parse()
 
@@ -524,12 +621,47 @@ func main() {
 		log.Fatal("Could not initilize the capture.")
 	}
 
+	statsdIntervalDur, err := time.ParseDuration(*statsdInterval)
+	if err != nil {
+		log.Fatal("Your statsd_interval parameter was not parseable.  Use a string like '2s'")
+	}
+
+	statsClient := stats.New(*statsdHost, *statsdPrefix, statsdIntervalDur)
+
+	if *stdoutFormat == "" {
+		*stdoutFormat = *format
+	}
+	if *logfileFormat == "" {
+		*logfileFormat = *format
+	}
+	if *kafkaFormat == "" {
+		*kafkaFormat = *format
+	}
+
 	logChan := initLogging(*debug)
 
+	shutdown := make(chan struct{})
+	var sinkWg sync.WaitGroup
+
 	//spin up logging thread(s)
-	go logConn(logChan, *quiet, *logFile, *kafkaBrokers, *kafkaTopic)
+	go logConn(logChan, *quiet, *logFile, *kafkaBrokers, *kafkaTopic,
+		*kafkaCompression, *kafkaAcks, *kafkaPartitionKey,
+		*stdoutFormat, *logfileFormat, *kafkaFormat, statsClient,
+		shutdown, &sinkWg)
+
+	//catch SIGTERM exactly once, here, so every sink gets a chance to
+	//flush whatever it's buffered before the process actually exits
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM)
+	go func() {
+		<-sigC
+		log.Debug("caught SIGTERM, flushing sinks before exit")
+		close(shutdown)
+		sinkWg.Wait()
+		os.Exit(0)
+	}()
 
 	//spin up the actual capture threads
-	doCapture(handle, logChan, *gcAge, *gcInterval)
+	doCapture(handle, logChan, *gcAge, *gcInterval, statsClient, statsdIntervalDur)
 
 }
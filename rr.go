@@ -0,0 +1,97 @@
+package main
+
+import "encoding/hex"
+import "fmt"
+import "strconv"
+import "strings"
+
+import "github.com/google/gopacket/layers"
+import "github.com/miekg/dns"
+
+/*
+gopacket only parses rdata for a handful of well-known types; everything
+else (and even some of those, like SOA/SRV/MX) gets stringified by hand
+in RrString below, which historically lost data (no MX priority, a
+truncated SOA, no DNSSEC or newer record types at all). For anything
+gopacket hasn't fully parsed, we hand the raw rdata to miekg/dns instead
+of growing this file into a second RR parser: synthesize an RFC 3597
+"unknown RR" zone-file line (". TTL CLASSn TYPEn \# len hex") and let
+dns.NewRR unpack it into the real typed RR, whose String() is the same
+thing dig would print.
+*/
+
+//gopacket's DNSType doesn't have constants for these, so name the ones
+//RrString/TypeString need to talk about.
+const (
+	dnsTypeNAPTR  layers.DNSType = 35
+	dnsTypeDS     layers.DNSType = 43
+	dnsTypeRRSIG  layers.DNSType = 46
+	dnsTypeNSEC   layers.DNSType = 47
+	dnsTypeDNSKEY layers.DNSType = 48
+	dnsTypeSVCB   layers.DNSType = 64
+	dnsTypeHTTPS  layers.DNSType = 65
+	dnsTypeCAA    layers.DNSType = 257
+)
+
+func RrString(rr layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA:
+		return rr.IP.String()
+	case layers.DNSTypeAAAA:
+		return rr.IP.String()
+	case layers.DNSTypeCNAME:
+		return string(rr.CNAME)
+	case layers.DNSTypeMX:
+		return strconv.Itoa(int(rr.MX.Preference)) + " " + string(rr.MX.Name)
+	case layers.DNSTypeNS:
+		return string(rr.NS)
+	case layers.DNSTypePTR:
+		return string(rr.PTR)
+	case layers.DNSTypeTXT:
+		return string(rr.TXT)
+	case layers.DNSTypeSOA:
+		return strings.Join([]string{
+			string(rr.SOA.MName),
+			string(rr.SOA.RName),
+			strconv.FormatUint(uint64(rr.SOA.Serial), 10),
+			strconv.FormatUint(uint64(rr.SOA.Refresh), 10),
+			strconv.FormatUint(uint64(rr.SOA.Retry), 10),
+			strconv.FormatUint(uint64(rr.SOA.Expire), 10),
+			strconv.FormatUint(uint64(rr.SOA.Minimum), 10),
+		}, " ")
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, rr.SRV.Name)
+	default:
+		//covers CAA/DS/DNSKEY/RRSIG/NSEC/HTTPS/SVCB/NAPTR plus anything
+		//else gopacket left as raw bytes
+		return rrStringViaMiekg(rr)
+	}
+}
+
+//rrStringViaMiekg reconstructs rr's rdata through miekg/dns so that
+//types gopacket doesn't parse still come out as dig would print them,
+//rather than raw bytes or being silently dropped.
+func rrStringViaMiekg(rr layers.DNSResourceRecord) string {
+	parsed, err := synthesizeRR(rr)
+	if err != nil || parsed == nil {
+		//couldn't make sense of it either way; at least don't lose the data
+		return string(rr.Data)
+	}
+
+	//parsed.String() is "name ttl class type rdata...", but the caller
+	//already tracks name/ttl/class/type itself, so trim those back off
+	fields := strings.SplitN(parsed.String(), "\t", 5)
+	if len(fields) < 5 {
+		return parsed.String()
+	}
+	return fields[4]
+}
+
+//synthesizeRR builds rr's rdata as an RFC 3597 unknown-RR-type zone-file
+//line and parses it with dns.NewRR, which unpacks the hex rdata into the
+//real typed RR (CAA, DS, DNSKEY, ...) when miekg/dns knows the type.
+func synthesizeRR(rr layers.DNSResourceRecord) (dns.RR, error) {
+	zone := fmt.Sprintf(". %d CLASS%d TYPE%d \\# %d %s",
+		rr.TTL, uint16(rr.Class), uint16(rr.Type), len(rr.Data), hex.EncodeToString(rr.Data))
+	return dns.NewRR(zone)
+}
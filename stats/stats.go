@@ -0,0 +1,56 @@
+/*
+Package stats wires the capture pipeline up to statsd so operators can
+watch packet rates, the 8-way worker fanout, and per-sink logging
+without having to turn on -debug.
+
+Metrics are reached through the Client interface rather than a
+statsd.StatsdBuffer directly, so that a deployment with -statsd_host unset
+gets a no-op implementation: every counter/gauge call on the hot path
+becomes a single interface call into an empty function body instead of a
+branch plus a network write.
+*/
+package stats
+
+import (
+	"time"
+
+	"github.com/quipo/statsd"
+)
+
+//Client is the metrics sink used throughout the capture pipeline.
+type Client interface {
+	Incr(stat string, count int64)
+	Gauge(stat string, value int64)
+}
+
+//New returns a statsd-backed Client flushing on the given interval, or a
+//no-op Client if host is empty.
+func New(host string, prefix string, interval time.Duration) Client {
+	if host == "" {
+		return nullClient{}
+	}
+
+	statsdClient := statsd.NewStatsdClient(host, prefix)
+	if err := statsdClient.CreateSocket(); err != nil {
+		return nullClient{}
+	}
+
+	return &bufferedClient{buffer: statsd.NewStatsdBuffer(interval, statsdClient)}
+}
+
+type bufferedClient struct {
+	buffer *statsd.StatsdBuffer
+}
+
+func (c *bufferedClient) Incr(stat string, count int64) {
+	c.buffer.Incr(stat, count)
+}
+
+func (c *bufferedClient) Gauge(stat string, value int64) {
+	c.buffer.Gauge(stat, value)
+}
+
+type nullClient struct{}
+
+func (nullClient) Incr(stat string, count int64)  {}
+func (nullClient) Gauge(stat string, value int64) {}
@@ -0,0 +1,103 @@
+package main
+
+import "encoding/binary"
+import "io"
+import "net"
+import "time"
+
+import log "github.com/Sirupsen/logrus"
+import "github.com/google/gopacket"
+import "github.com/google/gopacket/layers"
+import "github.com/google/gopacket/tcpassembly"
+import "github.com/google/gopacket/tcpassembly/tcpreader"
+
+/*
+DNS over TCP prefixes each message with a 2-octet big-endian length field,
+and a single TCP segment may contain a partial message, several whole
+messages, or both.  tcpassembly gives us a reassembled, in-order byte
+stream per TCP connection, which lets us read the length header and then
+read exactly that many bytes, regardless of how the sender chose to
+split them across segments.
+*/
+
+//a fully reassembled DNS message read off of a TCP stream, along with
+//the endpoints it was exchanged between.  This gets handed to the same
+//handleDns() codepath that UDP packets use.
+type dnsStreamMsg struct {
+	dns     *layers.DNS
+	srcIP   net.IP
+	srcPort uint16
+	dstIP   net.IP
+	dstPort uint16
+}
+
+//implements tcpassembly.StreamFactory.  One of these is created per
+//packet-handling worker, so that the streams it spawns can feed back
+//into that worker's handleDns()/conntable without any locking.
+type dnsStreamFactory struct {
+	tcpMsgs chan dnsStreamMsg
+}
+
+func (factory *dnsStreamFactory) New(netFlow, transport gopacket.Flow) tcpassembly.Stream {
+	stream := tcpreader.NewReaderStream()
+	go factory.run(&stream, netFlow, transport)
+	return &stream
+}
+
+//reads length-prefixed DNS messages off of a single reassembled TCP
+//stream until the stream closes, and forwards each one to the worker
+//that owns this factory.
+func (factory *dnsStreamFactory) run(stream *tcpreader.ReaderStream, netFlow gopacket.Flow, transport gopacket.Flow) {
+	srcIP := net.IP(netFlow.Src().Raw())
+	dstIP := net.IP(netFlow.Dst().Raw())
+	srcPort := binary.BigEndian.Uint16(transport.Src().Raw())
+	dstPort := binary.BigEndian.Uint16(transport.Dst().Raw())
+
+	for {
+		lengthBuf := make([]byte, 2)
+		if _, err := io.ReadFull(stream, lengthBuf); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				log.Debug("TCP DNS stream closed: " + err.Error())
+			}
+			return
+		}
+
+		length := binary.BigEndian.Uint16(lengthBuf)
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(stream, payload); err != nil {
+			log.Debug("short read reassembling TCP DNS message: " + err.Error())
+			return
+		}
+
+		dnsPacket := gopacket.NewPacket(payload, layers.LayerTypeDNS, gopacket.Default)
+		dnsLayer := dnsPacket.Layer(layers.LayerTypeDNS)
+		if dnsLayer == nil {
+			log.Debug("Got a non-DNS TCP payload")
+			continue
+		}
+
+		factory.tcpMsgs <- dnsStreamMsg{
+			dns:     dnsLayer.(*layers.DNS),
+			srcIP:   srcIP,
+			srcPort: srcPort,
+			dstIP:   dstIP,
+			dstPort: dstPort,
+		}
+	}
+}
+
+//evicts idle half-streams from every worker's assembler so that a
+//connection which never finishes (client vanished, RST dropped, etc)
+//doesn't pin memory forever.  tcpassembly.Assembler is documented as
+//unsafe for concurrent use, so this must be called from the same
+//goroutine that feeds AssembleWithTimestamp to these assemblers -
+//doCapture's capture loop drives it on a gcInterval ticker.
+func flushOldStreams(assemblers []*tcpassembly.Assembler, maxAge time.Duration) {
+	cutoff := time.Now().Add(maxAge)
+	for _, assembler := range assemblers {
+		flushed, closed := assembler.FlushOlderThan(cutoff)
+		if flushed > 0 || closed > 0 {
+			log.Debug("tcpassembly: flushed a stale half-stream")
+		}
+	}
+}